@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const defaultBackendName = "live-build"
+
+// Backend assembles a rootfs/ISO from a Profile. ConfigureProject runs
+// during "init" to lay down whatever project-local config the backend
+// needs; Clean discards the previous build's output; Assemble populates
+// the chroot; AssembleImage packages config/includes.binary (and
+// everything else Assemble produced) into the final image. Clean,
+// Assemble, and AssembleImage are separate pipeline steps in buildISO so
+// a build that fails partway through can be resumed without redoing
+// earlier steps, and so the "sign" step can run between Assemble and
+// AssembleImage: by then the chroot has the real shim/GRUB/systemd-boot
+// binaries to sign, but they haven't been packaged into the ISO yet.
+type Backend interface {
+	Name() string
+	ConfigureProject(p *Profile) error
+	Clean(p *Profile) error
+	Assemble(p *Profile, opts buildOptions) error
+	AssembleImage(p *Profile, opts buildOptions) error
+}
+
+// buildOptions carries the flags buildISO parses that backends need, so
+// adding a backend-specific flag doesn't change every Backend's signature.
+type buildOptions struct {
+	image           string // OCI image reference, used by the oci backend
+	sourceDateEpoch int64
+}
+
+func selectBackend(name string) (Backend, error) {
+	switch name {
+	case "", "live-build":
+		return liveBuildBackend{}, nil
+	case "mmdebstrap":
+		return mmdebstrapBackend{}, nil
+	case "debos":
+		return debosBackend{}, nil
+	case "oci":
+		return ociBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q (want one of: live-build, mmdebstrap, debos, oci)", name)
+	}
+}
+
+// lbConfig lays down the live-build project skeleton (config/binary,
+// config/chroot, config/source, ...) that `lb build` needs to assemble an
+// ISO regardless of which backend actually populates the chroot.
+func lbConfig(p *Profile) error {
+	cmd := exec.Command("lb", "config",
+		"--distribution", p.Suite,
+		"--architectures", strings.Join(p.Architectures, " "),
+		"--bootappend-live", "boot=live components username=hacker",
+		"--debian-installer", "live",
+		"--archive-areas", strings.Join(p.ArchiveAreas, " "),
+		"--debootstrap-options", "--variant=minbase",
+		"--firmware-binary", "true",
+		"--firmware-chroot", "true",
+		"--linux-flavours", "amd64",
+		"--system", "live",
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("lb config: %w", err)
+	}
+	return nil
+}
+
+// lbBinary runs live-build's binary stage, packaging whatever is under
+// config/includes.binary (plus the chroot a backend already populated)
+// into the final ISO.
+func lbBinary(opts buildOptions) error {
+	cmd := exec.Command("lb", "binary", "--binary-images", "iso-hybrid")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.sourceDateEpoch != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", opts.sourceDateEpoch))
+	}
+	return cmd.Run()
+}
+
+// markLBStageComplete writes live-build's own stage marker files so a
+// later `lb binary` treats those stages as already done and packages the
+// chroot some other backend already populated.
+func markLBStageComplete(stages ...string) error {
+	if err := os.MkdirAll(".build", 0755); err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		if err := os.WriteFile(filepath.Join(".build", stage), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveBuildBackend is the original behavior: lb config at init time, then
+// lb clean, lb chroot and lb binary as separate steps at build time.
+type liveBuildBackend struct{}
+
+func (liveBuildBackend) Name() string { return "live-build" }
+
+func (liveBuildBackend) ConfigureProject(p *Profile) error { return lbConfig(p) }
+
+func (liveBuildBackend) Clean(p *Profile) error {
+	cmd := exec.Command("lb", "clean", "--purge")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Assemble runs only live-build's bootstrap/chroot stages (lb chroot
+// chains to lb bootstrap itself), stopping short of packaging the chroot
+// into an image so the "sign" step can stage and sbsign EFI binaries
+// into config/includes.binary first.
+func (liveBuildBackend) Assemble(p *Profile, opts buildOptions) error {
+	cmd := exec.Command("lb", "chroot")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.sourceDateEpoch != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", opts.sourceDateEpoch))
+	}
+	return cmd.Run()
+}
+
+func (liveBuildBackend) AssembleImage(p *Profile, opts buildOptions) error {
+	cmd := exec.Command("lb", "binary")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.sourceDateEpoch != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", opts.sourceDateEpoch))
+	}
+	return cmd.Run()
+}
+
+// mmdebstrapBackend assembles the rootfs with mmdebstrap, which is faster
+// and can run unprivileged, then hands the result to lb's binary stage so
+// the rest of the ISO pipeline (bootloader, installer) is unchanged.
+type mmdebstrapBackend struct{}
+
+func (mmdebstrapBackend) Name() string { return "mmdebstrap" }
+
+// ConfigureProject still runs lb config: mmdebstrap replaces live-build's
+// own debootstrap stage, but lb binary still needs the rest of the project
+// skeleton (config/binary, config/source, ...) to assemble the ISO.
+func (mmdebstrapBackend) ConfigureProject(p *Profile) error { return lbConfig(p) }
+
+func (mmdebstrapBackend) Clean(p *Profile) error { return nil }
+
+func (mmdebstrapBackend) Assemble(p *Profile, opts buildOptions) error {
+	const chrootDir = "chroot"
+	args := []string{
+		"--variant=minbase",
+		"--architectures=" + strings.Join(p.Architectures, ","),
+		"--include=" + strings.Join(p.Packages, ","),
+		p.Suite,
+		chrootDir,
+	}
+	cmd := exec.Command("mmdebstrap", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.sourceDateEpoch != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", opts.sourceDateEpoch))
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mmdebstrap: %w", err)
+	}
+	return markLBStageComplete("bootstrap", "chroot")
+}
+
+func (mmdebstrapBackend) AssembleImage(p *Profile, opts buildOptions) error {
+	return lbBinary(opts)
+}
+
+// debosBackend is recipe-driven: the profile is rendered into a debos YAML
+// recipe once, and every build just re-runs debos against it.
+type debosBackend struct{}
+
+func (debosBackend) Name() string { return "debos" }
+
+func (debosBackend) Clean(p *Profile) error { return nil }
+
+func (debosBackend) ConfigureProject(p *Profile) error {
+	recipeDir := filepath.Join("config", "debos")
+	if err := os.MkdirAll(recipeDir, 0755); err != nil {
+		return err
+	}
+	recipe := fmt.Sprintf(`{{- $architecture := "%s" }}
+architecture: {{ $architecture }}
+actions:
+  - action: debootstrap
+    suite: %s
+    variant: minbase
+  - action: apt
+    packages: [%s]
+  - action: image-partition
+    imagename: hammer.img
+    partitiontype: gpt
+    mountpoints:
+      - {mountpoint: /, partition: root}
+    partitions:
+      - {name: root, fs: btrfs, start: 0%%, end: 100%%}
+`, p.Architectures[0], p.Suite, strings.Join(p.Packages, ", "))
+	return os.WriteFile(filepath.Join(recipeDir, "recipe.yaml"), []byte(recipe), 0644)
+}
+
+// debos produces the final image in a single recipe run rather than
+// separate chroot/binary stages, so there's nothing for Assemble to do;
+// the whole build happens in AssembleImage.
+func (debosBackend) Assemble(p *Profile, opts buildOptions) error { return nil }
+
+func (debosBackend) AssembleImage(p *Profile, opts buildOptions) error {
+	cmd := exec.Command("debos", filepath.Join("config", "debos", "recipe.yaml"))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.sourceDateEpoch != 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", opts.sourceDateEpoch))
+	}
+	return cmd.Run()
+}
+
+// ociBackend composes the rootfs from an OCI image instead of debootstrap,
+// then wraps it into a live ISO with lb's binary stage. This is the
+// backend hammer-updater's rebase --channel=oci pulls, so the same image
+// reference a user builds from here is the one deployments can rebase onto.
+type ociBackend struct{}
+
+func (ociBackend) Name() string { return "oci" }
+
+// ConfigureProject still runs lb config: the OCI image replaces
+// live-build's own debootstrap stage, but lb binary still needs the rest
+// of the project skeleton (config/binary, config/source, ...) to
+// assemble the ISO.
+func (ociBackend) ConfigureProject(p *Profile) error { return lbConfig(p) }
+
+func (ociBackend) Clean(p *Profile) error { return nil }
+
+func (ociBackend) Assemble(p *Profile, opts buildOptions) error {
+	if opts.image == "" {
+		return fmt.Errorf("--image is required for the oci backend")
+	}
+	if err := run("skopeo", "copy", "docker://"+opts.image, "containers-storage:"+opts.image); err != nil {
+		return fmt.Errorf("skopeo copy: %w", err)
+	}
+	mount, err := exec.Command("podman", "image", "mount", opts.image).Output()
+	if err != nil {
+		return fmt.Errorf("podman image mount: %w", err)
+	}
+	defer exec.Command("podman", "image", "unmount", opts.image).Run()
+	src := strings.TrimSpace(string(mount))
+	const chrootDir = "chroot"
+	if err := run("rsync", "-a", "--delete", src+"/", chrootDir+"/"); err != nil {
+		return fmt.Errorf("rsync: %w", err)
+	}
+	return markLBStageComplete("bootstrap", "chroot")
+}
+
+func (ociBackend) AssembleImage(p *Profile, opts buildOptions) error {
+	return lbBinary(opts)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
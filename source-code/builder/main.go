@@ -4,13 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-)
-
-const (
-	defaultSuite = "trixie" // Default to testing, adjust as needed
+	"time"
 )
 
 func main() {
@@ -21,261 +18,276 @@ func main() {
 	subcommand := os.Args[1]
 	args := os.Args[2:]
 	switch subcommand {
-		case "init":
-			initProject(args)
-		case "build":
-			buildISO(args)
-		default:
-			usage()
-			os.Exit(1)
+	case "init":
+		initProject(args)
+	case "build":
+		buildISO(args)
+	case "profile":
+		cmdProfile(args)
+	case "manifest":
+		cmdManifest(args)
+	case "verify":
+		cmdVerify(args)
+	case "sign":
+		cmdSign(args)
+	case "test":
+		cmdTest(args)
+	default:
+		usage()
+		os.Exit(1)
 	}
 }
 
 func initProject(args []string) {
 	fs := flag.NewFlagSet("init", flag.ExitOnError)
-	suite := fs.String("suite", defaultSuite, "Debian suite: stable, testing, sid, or codename")
-	atomic := fs.Bool("atomic", true, "Enable atomic features (BTRFS, deployments)")
+	profileName := fs.String("profile", defaultProfileName, "Build profile to render (see 'hammer-builder profile list')")
+	backendName := fs.String("backend", defaultBackendName, "Builder backend: live-build, mmdebstrap, debos, or oci")
+	resume := fs.Bool("resume", false, "Skip steps already completed by a previous init")
+	from := fs.String("from", "", "Start at this step instead of the first")
+	until := fs.String("until", "", "Stop after this step")
 	fs.Parse(args)
-	// Map common names to codenames
-	actualSuite := *suite
-	switch *suite {
-		case "stable":
-			actualSuite = "bookworm" // Update to current stable
-		case "testing":
-			actualSuite = "trixie"
-		case "sid":
-			actualSuite = "sid"
-	}
-	fmt.Printf("Initializing live-build project with suite: %s (atomic: %v)\n", actualSuite, *atomic)
-	// Check if config exists
+
 	if _, err := os.Stat("config"); err == nil {
-		fmt.Println("Project already initialized.")
-		os.Exit(1)
+		failPipeline(classify(ErrClassConfig, fmt.Errorf("project already initialized")))
 	}
-	// Run lb config with more options for installer
-	cmd := exec.Command("lb", "config",
-			    "--distribution", actualSuite,
-		     "--architectures", "amd64",
-		     "--bootappend-live", "boot=live components username=hacker",
-		     "--debian-installer", "live", // Enable installer
-		     "--archive-areas", "main contrib non-free non-free-firmware",
-		     "--debootstrap-options", "--variant=minbase",
-		     "--firmware-binary", "true",
-		     "--firmware-chroot", "true",
-		     "--linux-flavours", "amd64",
-		     "--system", "live",
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Failed to initialize: %v\n", err)
-		os.Exit(1)
-	}
-	// Create package lists
-	pkgListsDir := filepath.Join("config", "package-lists")
-	if err := os.MkdirAll(pkgListsDir, 0755); err != nil {
-		fmt.Printf("Failed to create package-lists dir: %v\n", err)
-		os.Exit(1)
+
+	// Loading the profile and picking the backend are cheap, in-memory
+	// steps: they always run so --resume/--from have a populated Profile
+	// and Backend to work with, rather than being part of the resumable
+	// pipeline themselves.
+	p, err := loadEffectiveProfile(*profileName)
+	if err != nil {
+		failPipeline(classify(ErrClassConfig, err))
 	}
-	// Base packages for atomic system
-	atomicPkgs := []string{
-		"btrfs-progs",
-		"podman",
-		"distrobox", // For container management
-		"grub-efi-amd64", // For booting
-		"grub-efi-amd64-signed",
-		"shim-signed",
-		"systemd-boot",
-		"calamares", // Installer
-		"calamares-settings-debian",
-		"rsync",
-		"curl",
-		"wget",
-		"git",
-		"linux-image-amd64",
-		"initramfs-tools",
-		"efibootmgr",
-		"dosfstools",
-		"parted",
-		// Add more as needed
+	if err := validateProfile(p); err != nil {
+		failPipeline(classify(ErrClassConfig, err))
 	}
-	pkgContent := strings.Join(atomicPkgs, "\n") + "\n"
-	pkgFile := filepath.Join(pkgListsDir, "atomic.list.chroot")
-	if err := os.WriteFile(pkgFile, []byte(pkgContent), 0644); err != nil {
-		fmt.Printf("Failed to write package list: %v\n", err)
-		os.Exit(1)
+	backend, err := selectBackend(*backendName)
+	if err != nil {
+		failPipeline(classify(ErrClassConfig, err))
 	}
-	// Create hooks dir
-	hooksDir := filepath.Join("config", "includes.chroot_after_packages/lib/live/config")
-	if err := os.MkdirAll(hooksDir, 0755); err != nil {
-		fmt.Printf("Failed to create hooks dir: %v\n", err)
-		os.Exit(1)
-	}
-	// Hook for BTRFS and atomic setup
-	hookFile := filepath.Join(hooksDir, "9999-setup-atomic.hook.chroot")
-	hookContent := `#!/bin/sh
-	set -e
-	echo "Setting up atomic features..."
-
-	# Configure podman for rootless if needed
-	su - hacker -c "podman system migrate" || true
 
-	# Set up directories for deployments
-	mkdir -p /btrfs-root/deployments
-
-	# Install hammer tools (assuming binaries are included)
-	echo "Hammer tools will be installed in /usr/local/bin/hammer"
-
-	# Configure Calamares for BTRFS atomic setup
-	if [ -d /usr/share/calamares ]; then
-		echo "Configuring Calamares for atomic BTRFS..."
-		mkdir -p /etc/calamares/modules
-
-		# Custom partitioning module for fixed BTRFS subvolumes layout
-		cat << EOF > /etc/calamares/modules/partition.conf
-		backend: libparted
-		efiSystemPartition: "/boot/efi"
-		efiSystemPartitionSize: 512M
-		swapChoice: none
-		userSwapChoices: none
-		filesystem: btrfs
-		EOF
+	steps := []Step{
+		{
+			Name: "configure-project",
+			Run: func() error {
+				return classify(ErrClassExec, backend.ConfigureProject(p))
+			},
+		},
+		{
+			Name: "write-package-list",
+			Run:  func() error { return classify(ErrClassIO, renderPackageList(p)) },
+		},
+		{
+			Name: "write-hooks",
+			Run:  func() error { return classify(ErrClassIO, renderHooks(p)) },
+		},
+		{
+			Name: "write-includes",
+			Run:  func() error { return classify(ErrClassIO, renderIncludes(p)) },
+		},
+		{
+			Name: "write-bootloader",
+			Run:  func() error { return classify(ErrClassIO, renderBootloader(p)) },
+		},
+		{
+			Name: "record-backend",
+			Run: func() error {
+				return classify(ErrClassIO, os.WriteFile(".hammer-backend", []byte(backend.Name()+"\n"), 0644))
+			},
+		},
+	}
 
-		# Custom shellprocess to setup subvolumes after partitioning
-		cat << EOF > /etc/calamares/modules/setupbtrfs.conf
-		---
-		type: shellprocess
-		commands:
-		- |
-		#!/bin/bash
-		set -e
-		ROOT_PART=\$(cat /tmp/calamares-root-part)
-		mount \$ROOT_PART /mnt
-		btrfs subvolume create /mnt/@root
-		btrfs subvolume create /mnt/@home
-		btrfs subvolume create /mnt/@var
-		btrfs subvolume create /mnt/@snapshots
-		umount /mnt
-		mount -o subvol=@root \$ROOT_PART /mnt
-		mkdir -p /mnt/home /mnt/var /mnt/.snapshots /mnt/btrfs-root
-		mount -o subvol=@home \$ROOT_PART /mnt/home
-		mount -o subvol=@var \$ROOT_PART /mnt/var
-		mount -o subvol=@snapshots \$ROOT_PART /mnt/.snapshots
-		mkdir -p /mnt/btrfs-root/deployments
-		# Set default subvol
-		DEFAULT_ID=\$(btrfs subvolume list /mnt | grep @root | awk '{print \$2}')
-		btrfs subvolume set-default \$DEFAULT_ID /mnt
-		# Create initial deployment snapshot
-		btrfs subvolume snapshot -r /mnt /mnt/btrfs-root/deployments/hammer-initial
-		ln -s /btrfs-root/deployments/hammer-initial /btrfs-root/current
-		# Update fstab
-		genfstab -U /mnt >> /mnt/etc/fstab
-		EOF
+	if err := runSteps(steps, runOptions{resume: *resume, from: *from, until: *until}); err != nil {
+		failPipeline(err)
+	}
+	fmt.Println("Project initialized. Edit profiles/ as needed.")
+	fmt.Println("To include hammer binaries, place them in the current directory before init.")
+}
 
-		# Add unpackfs module adjustment if needed
-		# Ensure Calamares sequence includes setupbtrfs after partition and before unpackfs
-		cat << EOF > /etc/calamares/settings.conf
-		---
-		sequence:
-		- show:
-		- welcome
-		- locale
-		- keyboard
-		- partition
-		- exec:
-		- partition
-		- mount
-		- setupbtrfs
-		- unpackfs
-		- sources
-		- ...
-		EOF
-		fi
+func buildISO(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	reproducible := fs.Bool("reproducible", false, "Pin apt to a snapshot.debian.org timestamp and force deterministic mksquashfs/xorriso output")
+	snapshotTimestamp := fs.String("snapshot-timestamp", "", "snapshot.debian.org timestamp to pin to (YYYYMMDDTHHMMSSZ); defaults to now when --reproducible is set")
+	signKey := fs.String("sign-key", "", "GPG key id to detached-sign hammer-image.json with")
+	backendName := fs.String("backend", "", "Builder backend override; defaults to the backend recorded at init time")
+	image := fs.String("image", "", "OCI image reference (required for --backend=oci)")
+	profileName := fs.String("profile", defaultProfileName, "Build profile to assemble")
+	sbKey := fs.String("sb-key", "", "Secure Boot signing key; together with --sb-cert, enables the UKI signing stage")
+	sbCert := fs.String("sb-cert", "", "Secure Boot signing certificate; together with --sb-key, enables the UKI signing stage")
+	pcrKey := fs.String("pcr-key", "", "TPM2 PCR private key to pre-calculate and embed a .pcrsig for")
+	resume := fs.Bool("resume", false, "Restart after a failed step without redoing earlier steps (e.g. debootstrap)")
+	from := fs.String("from", "", "Start at this step instead of the first")
+	until := fs.String("until", "", "Stop after this step")
+	fs.Parse(args)
 
-		# Make sure /etc/fstab has correct subvol mounts
+	if _, err := os.Stat("config"); os.IsNotExist(err) {
+		failPipeline(classify(ErrClassConfig, fmt.Errorf("not in a live-build project directory; run 'hammer-builder init' first")))
+	}
 
-		echo "Atomic setup completed."
-		`
-		if err := os.WriteFile(hookFile, []byte(hookContent), 0755); err != nil {
-			fmt.Printf("Failed to write hook: %v\n", err)
-			os.Exit(1)
+	// Resolving the backend/profile and pinning the reproducible snapshot
+	// are cheap, idempotent setup: they always run so --resume/--from have
+	// a populated Backend/Profile/SOURCE_DATE_EPOCH, rather than being
+	// part of the resumable pipeline themselves.
+	backend, err := selectBackend(resolveBackendName(*backendName))
+	if err != nil {
+		failPipeline(classify(ErrClassConfig, err))
+	}
+	p, err := loadEffectiveProfile(*profileName)
+	if err != nil {
+		failPipeline(classify(ErrClassConfig, err))
+	}
+	var sourceDateEpoch int64
+	if *reproducible {
+		if *snapshotTimestamp == "" {
+			*snapshotTimestamp = time.Now().UTC().Format("20060102T150405Z")
 		}
-		// Add includes for hammer binaries
-		hammerDir := filepath.Join("config", "includes.chroot/usr/local/bin")
-		if err := os.MkdirAll(hammerDir, 0755); err != nil {
-			fmt.Printf("Failed to create hammer dir: %v\n", err)
-			os.Exit(1)
+		if err := pinReproducibleBuild(p.Suite, *snapshotTimestamp); err != nil {
+			failPipeline(classify(ErrClassConfig, err))
 		}
-		// Placeholder: copy binaries if exist in current dir
-		for _, bin := range []string{"hammer", "hammer-core", "hammer-updater", "hammer-builder", "hammer-tui"} {
-			src := bin // Assume in current dir
-			if _, err := os.Stat(src); err == nil {
-				dst := filepath.Join(hammerDir, bin)
-				data, err := os.ReadFile(src)
+		sourceDateEpoch = sourceDateEpochFromEnv()
+	}
+	var manifest *BuildManifest
+
+	steps := []Step{
+		{
+			Name: "clean",
+			Run:  func() error { return classify(ErrClassExec, backend.Clean(p)) },
+		},
+		{
+			Name: "assemble",
+			Run: func() error {
+				opts := buildOptions{image: *image, sourceDateEpoch: sourceDateEpoch}
+				return classify(ErrClassExec, backend.Assemble(p, opts))
+			},
+		},
+		{
+			// Runs after the chroot is populated but before assemble-image
+			// packages config/includes.binary into the ISO, so the signed
+			// UKI/shim/GRUB/systemd-boot binaries actually end up shipped.
+			Name: "sign",
+			Skip: func() bool { return *sbKey == "" },
+			Run: func() error {
+				cfg := secureBootConfig{sbKey: *sbKey, sbCert: *sbCert, pcrKey: *pcrKey}
+				kernel, initrd, err := chrootKernelAndInitrd("chroot")
 				if err != nil {
-					fmt.Printf("Failed to read %s: %v\n", bin, err)
-					continue
+					return classify(ErrClassSign, err)
 				}
-				if err := os.WriteFile(dst, data, 0755); err != nil {
-					fmt.Printf("Failed to write %s: %v\n", bin, err)
+				return classify(ErrClassSign, signBuild("chroot", kernel, initrd, cfg))
+			},
+		},
+		{
+			Name: "assemble-image",
+			Run: func() error {
+				opts := buildOptions{image: *image, sourceDateEpoch: sourceDateEpoch}
+				return classify(ErrClassExec, backend.AssembleImage(p, opts))
+			},
+		},
+		{
+			Name: "manifest",
+			Run: func() error {
+				var err error
+				manifest, err = buildPackageManifest(filepath.Join("chroot"))
+				if err != nil {
+					return classify(ErrClassIO, err)
 				}
-			} else {
-				fmt.Printf("Warning: %s not found, skipping.\n", bin)
-			}
-		}
-		// Add boot loader config if needed
-		bootloaderDir := filepath.Join("config", "includes.binary/boot/grub")
-		if err := os.MkdirAll(bootloaderDir, 0755); err != nil {
-			fmt.Printf("Failed to create bootloader dir: %v\n", err)
-			os.Exit(1)
-		}
-		// Custom grub config for BTRFS
-		grubCfg := filepath.Join(bootloaderDir, "grub.cfg")
-		grubContent := `# Custom GRUB config for atomic system
-		set btrfs_relative_path=y
-		search --no-floppy --fs-uuid --set=root $rootuuid
-		configfile /@root/boot/grub/grub.cfg
-		`
-		if err := os.WriteFile(grubCfg, []byte(grubContent), 0644); err != nil {
-			fmt.Printf("Failed to write grub.cfg: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Println("Project initialized. Edit config/ as needed.")
-		fmt.Println("To include hammer binaries, place them in the current directory before init.")
+				manifest.SnapshotTimestamp = *snapshotTimestamp
+				manifest.SourceDateEpoch = sourceDateEpoch
+				if err := writeJSON(manifestFile, manifest); err != nil {
+					return classify(ErrClassIO, err)
+				}
+				return classify(ErrClassIO, writeJSON(sbomFile, manifestToSBOM(manifest)))
+			},
+		},
+		{
+			Name: "record-image-hashes",
+			Run: func() error {
+				err := recordImageHashes(isoPathGuess(), "binary/live/filesystem.squashfs",
+					"binary/live/vmlinuz", "binary/live/initrd.img", *signKey)
+				return classify(ErrClassVerify, err)
+			},
+		},
+	}
+
+	if err := runSteps(steps, runOptions{resume: *resume, from: *from, until: *until}); err != nil {
+		failPipeline(err)
+	}
+	fmt.Println("ISO built successfully. Find it as live-image-amd64.hybrid.iso or similar.")
 }
 
-func buildISO(args []string) {
-	fs := flag.NewFlagSet("build", flag.ExitOnError)
-	fs.Parse(args)
-	// Check if in project dir
-	if _, err := os.Stat("config"); os.IsNotExist(err) {
-		fmt.Println("Not in a live-build project directory. Run 'hammer-builder init' first.")
-		os.Exit(1)
+// pinReproducibleBuild writes a config/archives source list pinned to a
+// snapshot.debian.org timestamp and exports SOURCE_DATE_EPOCH, which every
+// tool the build runs afterwards inherits. It passes no mksquashfs or
+// xorriso options of its own.
+func pinReproducibleBuild(suite, timestamp string) error {
+	if timestamp == "" {
+		timestamp = time.Now().UTC().Format("20060102T150405Z")
 	}
-	fmt.Println("Building ISO...")
-	// Run lb clean first to ensure clean build
-	cleanCmd := exec.Command("lb", "clean", "--purge")
-	cleanCmd.Stdout = os.Stdout
-	cleanCmd.Stderr = os.Stderr
-	if err := cleanCmd.Run(); err != nil {
-		fmt.Printf("Failed to clean: %v\n", err)
-		// Continue or exit?
+	archivesDir := filepath.Join("config", "archives")
+	if err := os.MkdirAll(archivesDir, 0755); err != nil {
+		return err
 	}
-	// Run lb build
-	buildCmd := exec.Command("lb", "build")
-	buildCmd.Stdout = os.Stdout
-	buildCmd.Stderr = os.Stderr
-	if err := buildCmd.Run(); err != nil {
-		fmt.Printf("Failed to build: %v\n", err)
-		os.Exit(1)
+	snapshotList := fmt.Sprintf("deb [check-valid-until=no] http://snapshot.debian.org/archive/debian/%s %s main contrib non-free non-free-firmware\n", timestamp, suite)
+	if err := os.WriteFile(filepath.Join(archivesDir, "snapshot.list.chroot"), []byte(snapshotList), 0644); err != nil {
+		return err
 	}
-	fmt.Println("ISO built successfully. Find it as live-image-amd64.hybrid.iso or similar.")
+	epoch, err := timeFromSnapshotTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	return os.Setenv("SOURCE_DATE_EPOCH", fmt.Sprintf("%d", epoch))
+}
+
+func timeFromSnapshotTimestamp(timestamp string) (int64, error) {
+	t, err := time.Parse("20060102T150405Z", timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("parsing snapshot timestamp %q: %w", timestamp, err)
+	}
+	return t.Unix(), nil
+}
+
+func sourceDateEpochFromEnv() int64 {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return epoch
+}
+
+func isoPathGuess() string {
+	matches, err := filepath.Glob("live-image-*.hybrid.iso")
+	if err != nil || len(matches) == 0 {
+		return "live-image-amd64.hybrid.iso"
+	}
+	return matches[0]
+}
+
+// resolveBackendName honors an explicit --backend override, otherwise
+// falls back to whatever "init" recorded in .hammer-backend.
+func resolveBackendName(override string) string {
+	if override != "" {
+		return override
+	}
+	data, err := os.ReadFile(".hammer-backend")
+	if err != nil {
+		return defaultBackendName
+	}
+	return strings.TrimSpace(string(data))
 }
 
 func usage() {
 	fmt.Println("Usage: hammer-builder <command> [options]")
 	fmt.Println("")
 	fmt.Println("Commands:")
-	fmt.Println(" init [--suite <suite>] [--atomic] Initialize live-build project")
-	fmt.Println(" build Build the atomic ISO")
+	fmt.Println(" init     [--profile <name>] [--backend <name>] [--resume] [--from <step>] [--until <step>]")
+	fmt.Println("                                                             Initialize project from a profile")
+	fmt.Println(" build    [--backend <name>] [--image <ref>]               Build the atomic ISO")
+	fmt.Println("          [--reproducible] [--snapshot-timestamp <ts>] [--sign-key <id>]")
+	fmt.Println("          [--sb-key <key>] [--sb-cert <cert>] [--pcr-key <key>]")
+	fmt.Println("          [--resume] [--from <step>] [--until <step>]")
+	fmt.Println(" profile  <list|show|validate|render> [--backend <name>] [name]  Inspect or render build profiles")
+	fmt.Println(" manifest [--chroot <path>]                                 Regenerate the package manifest and SBOM")
+	fmt.Println(" verify   <iso>                                             Check an ISO's hashes against hammer-image.json")
+	fmt.Println(" sign     --sb-key <key> --sb-cert <cert> [--pcr-key <key>] <uki>  Re-sign a UKI with a different key")
+	fmt.Println(" test     [--iso <path>] [--ovmf <path>] [--junit <path>]   Boot the ISO in QEMU and run the checklist")
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	manifestFile = "hammer-manifest.json"
+	sbomFile     = "hammer-sbom.json"
+	imageFile    = "hammer-image.json"
+)
+
+// PackageEntry records one installed package as it was laid down in the
+// chroot, enough to reproduce or audit the build later.
+type PackageEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	SHA256  string `json:"sha256"`
+}
+
+// BuildManifest is the full record of what went into a build: the pinned
+// snapshot timestamp, SOURCE_DATE_EPOCH, and every installed package.
+type BuildManifest struct {
+	SnapshotTimestamp string         `json:"snapshot_timestamp,omitempty"`
+	SourceDateEpoch   int64          `json:"source_date_epoch,omitempty"`
+	Packages          []PackageEntry `json:"packages"`
+}
+
+// ImageHashes is the sha256 of every artifact a build produced, plus the
+// short digest used as the shortsha component of a hammer-updater
+// deployment name, so a deployed system can report exactly which build it
+// came from.
+type ImageHashes struct {
+	ISO            string `json:"iso,omitempty"`
+	Squashfs       string `json:"squashfs,omitempty"`
+	Kernel         string `json:"kernel,omitempty"`
+	Initrd         string `json:"initrd,omitempty"`
+	ManifestDigest string `json:"manifest_digest"`
+}
+
+func cmdManifest(args []string) {
+	fs := flag.NewFlagSet("manifest", flag.ExitOnError)
+	chroot := fs.String("chroot", filepath.Join("chroot"), "Path to the built chroot to inventory")
+	fs.Parse(args)
+
+	manifest, err := buildPackageManifest(*chroot)
+	if err != nil {
+		fmt.Printf("Failed to build manifest: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeJSON(manifestFile, manifest); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", manifestFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s (%d packages)\n", manifestFile, len(manifest.Packages))
+
+	sbom := manifestToSBOM(manifest)
+	if err := writeJSON(sbomFile, sbom); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", sbomFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s\n", sbomFile)
+}
+
+func cmdVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: hammer-builder verify <iso>")
+		os.Exit(1)
+	}
+	isoPath := fs.Arg(0)
+
+	var recorded ImageHashes
+	if err := readJSON(imageFile, &recorded); err != nil {
+		fmt.Printf("Failed to read %s: %v\n", imageFile, err)
+		os.Exit(1)
+	}
+
+	actualISO, err := sha256File(isoPath)
+	if err != nil {
+		fmt.Printf("Failed to hash %s: %v\n", isoPath, err)
+		os.Exit(1)
+	}
+	if actualISO != recorded.ISO {
+		fmt.Printf("MISMATCH: iso sha256 is %s, manifest recorded %s\n", actualISO, recorded.ISO)
+		os.Exit(1)
+	}
+
+	for _, check := range []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"squashfs", "binary/live/filesystem.squashfs", recorded.Squashfs},
+		{"kernel", "binary/live/vmlinuz", recorded.Kernel},
+		{"initrd", "binary/live/initrd.img", recorded.Initrd},
+	} {
+		if check.expected == "" {
+			continue
+		}
+		actual, err := sha256File(check.path)
+		if err != nil {
+			fmt.Printf("Failed to hash %s: %v\n", check.path, err)
+			os.Exit(1)
+		}
+		if actual != check.expected {
+			fmt.Printf("MISMATCH: %s sha256 is %s, manifest recorded %s\n", check.name, actual, check.expected)
+			os.Exit(1)
+		}
+	}
+
+	var manifest BuildManifest
+	if err := readJSON(manifestFile, &manifest); err != nil {
+		fmt.Printf("Failed to read %s: %v\n", manifestFile, err)
+		os.Exit(1)
+	}
+	actualDigest, err := manifestShortDigest(manifestFile)
+	if err != nil {
+		fmt.Printf("Failed to digest %s: %v\n", manifestFile, err)
+		os.Exit(1)
+	}
+	if actualDigest != recorded.ManifestDigest {
+		fmt.Printf("MISMATCH: manifest digest is %s, hammer-image.json recorded %s\n", actualDigest, recorded.ManifestDigest)
+		os.Exit(1)
+	}
+	fmt.Println("OK: iso and manifest hashes match hammer-image.json")
+}
+
+// buildPackageManifest inventories every package installed into chroot by
+// querying dpkg's own database, rather than re-deriving it from the package
+// lists the build started from.
+func buildPackageManifest(chroot string) (*BuildManifest, error) {
+	admindir := filepath.Join(chroot, "var/lib/dpkg")
+	out, err := exec.Command("dpkg-query", "--admindir", admindir,
+		"-W", "-f", "${Package}\t${Version}\t${Architecture}\n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("dpkg-query: %w", err)
+	}
+	manifest := &BuildManifest{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		sha, err := packageFilesSHA256(chroot, admindir, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("hashing files owned by %s: %w", fields[0], err)
+		}
+		manifest.Packages = append(manifest.Packages, PackageEntry{
+			Name:    fields[0],
+			Version: fields[1],
+			Arch:    fields[2],
+			SHA256:  sha,
+		})
+	}
+	return manifest, nil
+}
+
+// packageFilesSHA256 hashes the actual installed content of every regular
+// file dpkg recorded as belonging to name, rather than the package's own
+// name/version/arch tuple, so a corrupted or tampered file under chroot
+// changes the recorded digest.
+func packageFilesSHA256(chroot, admindir, name string) (string, error) {
+	out, err := exec.Command("dpkg-query", "--admindir", admindir, "-L", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("dpkg-query -L %s: %w", name, err)
+	}
+	paths := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		full := filepath.Join(chroot, p)
+		info, err := os.Lstat(full)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(full)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cycloneDXComponent and cycloneDXSBOM are a minimal CycloneDX 1.5
+// rendering of a BuildManifest, sufficient for downstream SBOM tooling to
+// ingest without pulling in a dedicated library.
+type cycloneDXComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	PURL    string `json:"purl"`
+}
+
+type cycloneDXSBOM struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+func manifestToSBOM(manifest *BuildManifest) *cycloneDXSBOM {
+	sbom := &cycloneDXSBOM{BOMFormat: "CycloneDX", SpecVersion: "1.5"}
+	for _, pkg := range manifest.Packages {
+		sbom.Components = append(sbom.Components, cycloneDXComponent{
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    fmt.Sprintf("pkg:deb/debian/%s@%s?arch=%s", pkg.Name, pkg.Version, pkg.Arch),
+		})
+	}
+	return sbom
+}
+
+// recordImageHashes hashes every artifact buildISO produced and writes
+// hammer-image.json, then detached-signs it when signKey is set.
+func recordImageHashes(isoPath, squashfsPath, kernelPath, initrdPath, signKey string) error {
+	hashes := ImageHashes{}
+	var err error
+	if hashes.ISO, err = sha256File(isoPath); err != nil {
+		return err
+	}
+	if hashes.Squashfs, err = sha256FileIfExists(squashfsPath); err != nil {
+		return err
+	}
+	if hashes.Kernel, err = sha256FileIfExists(kernelPath); err != nil {
+		return err
+	}
+	if hashes.Initrd, err = sha256FileIfExists(initrdPath); err != nil {
+		return err
+	}
+	if hashes.ManifestDigest, err = manifestShortDigest(manifestFile); err != nil {
+		return err
+	}
+	if err := writeJSON(imageFile, hashes); err != nil {
+		return err
+	}
+	if signKey != "" {
+		return signFile(imageFile, signKey)
+	}
+	return nil
+}
+
+func manifestShortDigest(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return sha256String(string(data))[:12], nil
+}
+
+func signFile(path, key string) error {
+	cmd := exec.Command("gpg", "--batch", "--yes", "--local-user", key, "--detach-sign", "--armor", path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func sha256String(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sha256FileIfExists(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return sha256File(path)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	profilesDir        = "profiles"
+	singleProfileFile  = "hammer.yaml"
+	defaultProfileName = "full"
+)
+
+// CalamaresProfile configures the generated Calamares partition/shellprocess
+// modules for the atomic BTRFS layout.
+type CalamaresProfile struct {
+	Filesystem string `yaml:"filesystem,omitempty"`
+	EFISize    string `yaml:"efi_size,omitempty"`
+	SwapChoice string `yaml:"swap_choice,omitempty"`
+}
+
+// BootloaderProfile selects and configures the bootloader the rendered
+// config tree should ship.
+type BootloaderProfile struct {
+	Kind string `yaml:"kind,omitempty"` // "grub" or "systemd-boot"
+}
+
+// Profile is a declarative build profile, loaded from profiles/<name>.yaml
+// (or a single hammer.yaml), that replaces the previously hardcoded package
+// list and hook content. Profiles may extend one another; fields set on a
+// child override the parent, list fields are unioned — except
+// packages_remove, which subtracts from the merged packages list so a child
+// can narrow a parent's package set instead of only ever adding to it.
+type Profile struct {
+	Name           string            `yaml:"-"`
+	Extends        string            `yaml:"extends,omitempty"`
+	Suite          string            `yaml:"suite,omitempty"`
+	Architectures  []string          `yaml:"architectures,omitempty"`
+	ArchiveAreas   []string          `yaml:"archive_areas,omitempty"`
+	Packages       []string          `yaml:"packages,omitempty"`
+	PackagesRemove []string          `yaml:"packages_remove,omitempty"`
+	Includes       []string          `yaml:"includes,omitempty"`
+	Hooks          map[string]string `yaml:"hooks,omitempty"`
+	Calamares      CalamaresProfile  `yaml:"calamares,omitempty"`
+	Bootloader     BootloaderProfile `yaml:"bootloader,omitempty"`
+}
+
+// defaultFullProfile is written out as profiles/full.yaml the first time
+// "hammer-builder init" runs in a directory with no profile files yet, so
+// there is always something to edit, render and extend from.
+const defaultFullProfile = `suite: trixie
+architectures: [amd64]
+archive_areas: [main, contrib, non-free, non-free-firmware]
+packages:
+  - btrfs-progs
+  - podman
+  - distrobox
+  - grub-efi-amd64
+  - grub-efi-amd64-signed
+  - shim-signed
+  - systemd-boot
+  - calamares
+  - calamares-settings-debian
+  - rsync
+  - curl
+  - wget
+  - git
+  - linux-image-amd64
+  - initramfs-tools
+  - efibootmgr
+  - dosfstools
+  - parted
+calamares:
+  filesystem: btrfs
+  efi_size: 512M
+  swap_choice: none
+bootloader:
+  kind: grub
+`
+
+const defaultMinimalProfile = `extends: full
+packages_remove:
+  - podman
+  - distrobox
+  - systemd-boot
+  - calamares
+  - calamares-settings-debian
+  - rsync
+  - curl
+  - wget
+  - git
+`
+
+const defaultNoExtraProfile = `extends: full
+packages_remove:
+  - podman
+  - distrobox
+  - systemd-boot
+  - rsync
+  - curl
+  - wget
+  - git
+`
+
+func cmdProfile(args []string) {
+	if len(args) < 1 {
+		profileUsage()
+		os.Exit(1)
+	}
+	action, rest := args[0], args[1:]
+	switch action {
+	case "list":
+		profileList()
+	case "show":
+		profileShow(rest)
+	case "validate":
+		profileValidate(rest)
+	case "render":
+		profileRender(rest)
+	default:
+		profileUsage()
+		os.Exit(1)
+	}
+}
+
+func profileUsage() {
+	fmt.Println("Usage: hammer-builder profile <list|show|validate|render> [name]")
+}
+
+func profileList() {
+	ensureDefaultProfiles()
+	entries, err := os.ReadDir(profilesDir)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", profilesDir, err)
+		os.Exit(1)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".yaml") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".yaml"))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+func profileShow(args []string) {
+	name := profileArgOrDefault(args)
+	p, err := loadEffectiveProfile(name)
+	if err != nil {
+		fmt.Printf("Failed to load profile %q: %v\n", name, err)
+		os.Exit(1)
+	}
+	out, err := yaml.Marshal(p)
+	if err != nil {
+		fmt.Printf("Failed to marshal profile: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(string(out))
+}
+
+func profileValidate(args []string) {
+	name := profileArgOrDefault(args)
+	p, err := loadEffectiveProfile(name)
+	if err != nil {
+		fmt.Printf("Failed to load profile %q: %v\n", name, err)
+		os.Exit(1)
+	}
+	if err := validateProfile(p); err != nil {
+		fmt.Printf("Profile %q is invalid: %v\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Profile %q is valid.\n", name)
+}
+
+func profileRender(args []string) {
+	fs := flag.NewFlagSet("profile render", flag.ExitOnError)
+	backendName := fs.String("backend", defaultBackendName, "Builder backend: live-build, mmdebstrap, debos, or oci")
+	fs.Parse(args)
+	name := profileArgOrDefault(fs.Args())
+
+	p, err := loadEffectiveProfile(name)
+	if err != nil {
+		fmt.Printf("Failed to load profile %q: %v\n", name, err)
+		os.Exit(1)
+	}
+	if err := validateProfile(p); err != nil {
+		fmt.Printf("Profile %q is invalid: %v\n", name, err)
+		os.Exit(1)
+	}
+	backend, err := selectBackend(*backendName)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := renderConfigTree(p, backend); err != nil {
+		fmt.Printf("Failed to render config tree: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rendered profile %q into config/ with backend %q\n", name, backend.Name())
+}
+
+func profileArgOrDefault(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return defaultProfileName
+}
+
+func validateProfile(p *Profile) error {
+	if p.Suite == "" {
+		return fmt.Errorf("suite is not set")
+	}
+	if len(p.Architectures) == 0 {
+		return fmt.Errorf("architectures is empty")
+	}
+	if len(p.Packages) == 0 {
+		return fmt.Errorf("packages is empty")
+	}
+	return nil
+}
+
+// ensureDefaultProfiles writes the full/minimal/no_extra starter profiles
+// into profiles/ the first time hammer-builder runs in a directory that has
+// neither profiles/ nor a single hammer.yaml yet.
+func ensureDefaultProfiles() {
+	if _, err := os.Stat(profilesDir); err == nil {
+		return
+	}
+	if _, err := os.Stat(singleProfileFile); err == nil {
+		return
+	}
+	if err := os.MkdirAll(profilesDir, 0755); err != nil {
+		return
+	}
+	defaults := map[string]string{
+		"full.yaml":     defaultFullProfile,
+		"minimal.yaml":  defaultMinimalProfile,
+		"no_extra.yaml": defaultNoExtraProfile,
+	}
+	for filename, content := range defaults {
+		os.WriteFile(filepath.Join(profilesDir, filename), []byte(content), 0644)
+	}
+}
+
+// loadEffectiveProfile resolves name to a Profile, following its extends:
+// chain and merging parent into child along the way. It looks for
+// profiles/<name>.yaml first, falling back to a single hammer.yaml for
+// projects that don't need the full profiles/ directory.
+func loadEffectiveProfile(name string) (*Profile, error) {
+	ensureDefaultProfiles()
+	return loadProfileChain(name, map[string]bool{})
+}
+
+func loadProfileChain(name string, seen map[string]bool) (*Profile, error) {
+	if seen[name] {
+		return nil, fmt.Errorf("cycle detected in extends chain at %q", name)
+	}
+	seen[name] = true
+
+	raw, err := readProfileFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := yaml.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("parsing profile %q: %w", name, err)
+	}
+	p.Name = name
+
+	if p.Extends == "" {
+		return &p, nil
+	}
+	parent, err := loadProfileChain(p.Extends, seen)
+	if err != nil {
+		return nil, err
+	}
+	return mergeProfiles(parent, &p), nil
+}
+
+func readProfileFile(name string) ([]byte, error) {
+	path := filepath.Join(profilesDir, name+".yaml")
+	if data, err := os.ReadFile(path); err == nil {
+		return data, nil
+	}
+	if data, err := os.ReadFile(singleProfileFile); err == nil {
+		return data, nil
+	}
+	return nil, fmt.Errorf("no profile named %q found under %s/ or %s", name, profilesDir, singleProfileFile)
+}
+
+// mergeProfiles layers child over parent: scalar fields in child win when
+// set, list fields are unioned, and hooks are merged by filename.
+func mergeProfiles(parent, child *Profile) *Profile {
+	merged := *parent
+	merged.Name = child.Name
+	merged.Extends = ""
+
+	if child.Suite != "" {
+		merged.Suite = child.Suite
+	}
+	merged.Architectures = unionStrings(parent.Architectures, child.Architectures)
+	merged.ArchiveAreas = unionStrings(parent.ArchiveAreas, child.ArchiveAreas)
+	merged.Packages = subtractStrings(unionStrings(parent.Packages, child.Packages), child.PackagesRemove)
+	merged.PackagesRemove = nil
+	merged.Includes = unionStrings(parent.Includes, child.Includes)
+
+	merged.Hooks = map[string]string{}
+	for k, v := range parent.Hooks {
+		merged.Hooks[k] = v
+	}
+	for k, v := range child.Hooks {
+		merged.Hooks[k] = v
+	}
+
+	if child.Calamares.Filesystem != "" || child.Calamares.EFISize != "" || child.Calamares.SwapChoice != "" {
+		merged.Calamares = child.Calamares
+	}
+	if child.Bootloader.Kind != "" {
+		merged.Bootloader = child.Bootloader
+	}
+	return &merged
+}
+
+// subtractStrings returns the elements of a not present in remove, so a
+// child profile's packages_remove can narrow a parent's package list
+// instead of only ever being able to add to it via unionStrings.
+func subtractStrings(a, remove []string) []string {
+	if len(remove) == 0 {
+		return a
+	}
+	drop := map[string]bool{}
+	for _, s := range remove {
+		drop[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !drop[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func unionStrings(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// renderConfigTree turns an effective Profile into the on-disk config/ tree
+// a build expects: the backend's own project setup, package lists, hooks,
+// Calamares modules and bootloader config. This replaces the single
+// hardcoded atomicPkgs/hookContent path that used to live in initProject.
+func renderConfigTree(p *Profile, backend Backend) error {
+	if err := backend.ConfigureProject(p); err != nil {
+		return fmt.Errorf("%s: %w", backend.Name(), err)
+	}
+
+	if err := renderPackageList(p); err != nil {
+		return err
+	}
+	if err := renderHooks(p); err != nil {
+		return err
+	}
+	if err := renderIncludes(p); err != nil {
+		return err
+	}
+	if err := renderBootloader(p); err != nil {
+		return err
+	}
+	return nil
+}
+
+func renderPackageList(p *Profile) error {
+	pkgListsDir := filepath.Join("config", "package-lists")
+	if err := os.MkdirAll(pkgListsDir, 0755); err != nil {
+		return fmt.Errorf("creating package-lists dir: %w", err)
+	}
+	pkgContent := strings.Join(p.Packages, "\n") + "\n"
+	pkgFile := filepath.Join(pkgListsDir, p.Name+".list.chroot")
+	return os.WriteFile(pkgFile, []byte(pkgContent), 0644)
+}
+
+func renderHooks(p *Profile) error {
+	hooksDir := filepath.Join("config", "includes.chroot_after_packages/lib/live/config")
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return fmt.Errorf("creating hooks dir: %w", err)
+	}
+	if len(p.Hooks) == 0 {
+		// No hooks declared: fall back to the built-in atomic BTRFS setup
+		// hook so a profile doesn't have to restate it verbatim.
+		p = mergeProfiles(&Profile{Hooks: map[string]string{"9999-setup-atomic.hook.chroot": builtinAtomicHook}}, p)
+	}
+	for filename, content := range p.Hooks {
+		path := filepath.Join(hooksDir, filename)
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			return fmt.Errorf("writing hook %s: %w", filename, err)
+		}
+	}
+	return renderCalamares(p)
+}
+
+func renderCalamares(p *Profile) error {
+	if p.Calamares.Filesystem == "" {
+		return nil
+	}
+	calamaresDir := filepath.Join("config", "includes.chroot/etc/calamares/modules")
+	if err := os.MkdirAll(calamaresDir, 0755); err != nil {
+		return fmt.Errorf("creating calamares modules dir: %w", err)
+	}
+	partitionConf := fmt.Sprintf(`backend: libparted
+efiSystemPartition: "/boot/efi"
+efiSystemPartitionSize: %s
+swapChoice: %s
+userSwapChoices: %s
+filesystem: %s
+`, p.Calamares.EFISize, p.Calamares.SwapChoice, p.Calamares.SwapChoice, p.Calamares.Filesystem)
+	if err := os.WriteFile(filepath.Join(calamaresDir, "partition.conf"), []byte(partitionConf), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(calamaresDir, "setupbtrfs.conf"), []byte(setupBtrfsModule), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join("config", "includes.chroot/etc/calamares/settings.conf"), []byte(calamaresSequence), 0644)
+}
+
+const setupBtrfsModule = `---
+type: shellprocess
+commands:
+- |
+  #!/bin/bash
+  set -e
+  ROOT_PART=$(cat /tmp/calamares-root-part)
+  mount $ROOT_PART /mnt
+  btrfs subvolume create /mnt/@root
+  btrfs subvolume create /mnt/@home
+  btrfs subvolume create /mnt/@var
+  btrfs subvolume create /mnt/@snapshots
+  umount /mnt
+  mount -o subvol=@root $ROOT_PART /mnt
+  mkdir -p /mnt/home /mnt/var /mnt/.snapshots /mnt/btrfs-root
+  mount -o subvol=@home $ROOT_PART /mnt/home
+  mount -o subvol=@var $ROOT_PART /mnt/var
+  mount -o subvol=@snapshots $ROOT_PART /mnt/.snapshots
+  mkdir -p /mnt/btrfs-root/deployments
+  DEFAULT_ID=$(btrfs subvolume list /mnt | grep @root | awk '{print $2}')
+  btrfs subvolume set-default $DEFAULT_ID /mnt
+  btrfs subvolume snapshot -r /mnt /mnt/btrfs-root/deployments/hammer-initial
+  ln -s /btrfs-root/deployments/hammer-initial /btrfs-root/current
+  genfstab -U /mnt >> /mnt/etc/fstab
+`
+
+const calamaresSequence = `---
+sequence:
+- show:
+  - welcome
+  - locale
+  - keyboard
+  - partition
+- exec:
+  - partition
+  - mount
+  - setupbtrfs
+  - unpackfs
+  - sources
+- ...
+`
+
+func renderIncludes(p *Profile) error {
+	hammerDir := filepath.Join("config", "includes.chroot/usr/local/bin")
+	if err := os.MkdirAll(hammerDir, 0755); err != nil {
+		return fmt.Errorf("creating hammer includes dir: %w", err)
+	}
+	bins := []string{"hammer", "hammer-core", "hammer-updater", "hammer-builder", "hammer-tui"}
+	bins = append(bins, p.Includes...)
+	for _, bin := range bins {
+		src := bin
+		if _, err := os.Stat(src); err != nil {
+			fmt.Printf("Warning: %s not found, skipping.\n", bin)
+			continue
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			fmt.Printf("Failed to read %s: %v\n", bin, err)
+			continue
+		}
+		dst := filepath.Join(hammerDir, filepath.Base(bin))
+		if err := os.WriteFile(dst, data, 0755); err != nil {
+			fmt.Printf("Failed to write %s: %v\n", bin, err)
+		}
+	}
+	return nil
+}
+
+func renderBootloader(p *Profile) error {
+	switch p.Bootloader.Kind {
+	case "systemd-boot":
+		return nil // systemd-boot entries are written by hammer-updater at deploy time
+	default:
+		bootloaderDir := filepath.Join("config", "includes.binary/boot/grub")
+		if err := os.MkdirAll(bootloaderDir, 0755); err != nil {
+			return fmt.Errorf("creating bootloader dir: %w", err)
+		}
+		grubContent := `# Custom GRUB config for atomic system
+set btrfs_relative_path=y
+search --no-floppy --fs-uuid --set=root $rootuuid
+configfile /@root/boot/grub/grub.cfg
+`
+		return os.WriteFile(filepath.Join(bootloaderDir, "grub.cfg"), []byte(grubContent), 0644)
+	}
+}
+
+const builtinAtomicHook = `#!/bin/sh
+set -e
+echo "Setting up atomic features..."
+
+# Configure podman for rootless if needed
+su - hacker -c "podman system migrate" || true
+
+# Set up directories for deployments
+mkdir -p /btrfs-root/deployments
+
+# Install hammer tools (assuming binaries are included)
+echo "Hammer tools will be installed in /usr/local/bin/hammer"
+`
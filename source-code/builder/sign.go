@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const ukiPath = "config/includes.binary/EFI/Linux/hammer.efi"
+
+// secureBootConfig carries the signing material for a build: sbKey/sbCert
+// sign the UKI and the shim/GRUB/systemd-boot binaries with sbsign, and
+// pcrKey additionally pre-calculates and embeds TPM2 PCR signatures so the
+// UKI can unlock a LUKS-encrypted /var at boot without prompting.
+type secureBootConfig struct {
+	sbKey  string
+	sbCert string
+	pcrKey string
+}
+
+func (c secureBootConfig) enabled() bool { return c.sbKey != "" && c.sbCert != "" }
+
+// chrootKernelAndInitrd finds the kernel/initrd a backend's Assemble step
+// installed into chroot. The "sign" step runs before AssembleImage's
+// live-build binary stage copies these into binary/live/ itself, so that
+// copy doesn't exist yet — the chroot's own /boot is the only place to
+// find them at this point.
+func chrootKernelAndInitrd(chroot string) (kernel, initrd string, err error) {
+	kernels, err := filepath.Glob(filepath.Join(chroot, "boot", "vmlinuz-*"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(kernels) == 0 {
+		return "", "", fmt.Errorf("no kernel found under %s", filepath.Join(chroot, "boot"))
+	}
+	initrds, err := filepath.Glob(filepath.Join(chroot, "boot", "initrd.img-*"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(initrds) == 0 {
+		return "", "", fmt.Errorf("no initrd found under %s", filepath.Join(chroot, "boot"))
+	}
+	return kernels[len(kernels)-1], initrds[len(initrds)-1], nil
+}
+
+// signBuild builds a Unified Kernel Image from the kernel/initrd the
+// chroot's Assemble step just installed and sbsigns it along with every
+// shim/GRUB/systemd-boot binary the profile's package list put there too.
+func signBuild(chroot, kernelPath, initrdPath string, cfg secureBootConfig) error {
+	if !cfg.enabled() {
+		return nil
+	}
+	staged, err := stageBootBinaries(chroot)
+	if err != nil {
+		return fmt.Errorf("staging boot binaries: %w", err)
+	}
+	if staged == 0 {
+		fmt.Println("Warning: no shim/GRUB/systemd-boot EFI binaries found in chroot to stage for signing.")
+	}
+	if err := os.MkdirAll(filepath.Dir(ukiPath), 0755); err != nil {
+		return fmt.Errorf("creating UKI output dir: %w", err)
+	}
+	if err := buildUKI(kernelPath, initrdPath, cfg, ukiPath); err != nil {
+		return fmt.Errorf("ukify: %w", err)
+	}
+	if err := sbsign(ukiPath, cfg); err != nil {
+		return fmt.Errorf("sbsign uki: %w", err)
+	}
+	return signStagedBootBinaries(cfg)
+}
+
+// bootEFISources maps the shim/GRUB/systemd-boot EFI binaries the profile's
+// package list (shim-signed, grub-efi-amd64-signed, systemd-boot) installs
+// into chroot to where they need to land under config/includes.binary, so
+// live-build's binary stage ships them and signStagedBootBinaries below can
+// find and sbsign them.
+var bootEFISources = map[string]string{
+	filepath.Join("usr", "lib", "shim", "shimx64.efi.signed"):                      filepath.Join("EFI", "BOOT", "BOOTX64.EFI"),
+	filepath.Join("usr", "lib", "shim", "shimx64.efi"):                             filepath.Join("EFI", "BOOT", "BOOTX64.EFI"),
+	filepath.Join("usr", "lib", "grub", "x86_64-efi", "monolithic", "grubx64.efi"): filepath.Join("EFI", "debian", "grubx64.efi"),
+	filepath.Join("usr", "lib", "systemd", "boot", "efi", "systemd-bootx64.efi"):   filepath.Join("EFI", "systemd", "systemd-bootx64.efi"),
+}
+
+// stageBootBinaries copies whichever of bootEFISources exist in chroot out
+// to config/includes.binary, so they're both shipped in the ISO and found
+// by signStagedBootBinaries. Returns how many binaries it staged.
+func stageBootBinaries(chroot string) (int, error) {
+	binDir := "config/includes.binary"
+	staged := 0
+	for src, dst := range bootEFISources {
+		srcPath := filepath.Join(chroot, src)
+		if _, err := os.Stat(srcPath); err != nil {
+			continue
+		}
+		dstPath := filepath.Join(binDir, dst)
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			return staged, err
+		}
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return staged, fmt.Errorf("staging %s: %w", srcPath, err)
+		}
+		staged++
+	}
+	return staged, nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0755)
+}
+
+func buildUKI(kernelPath, initrdPath string, cfg secureBootConfig, out string) error {
+	args := []string{
+		"build",
+		"--linux", kernelPath,
+		"--initrd", initrdPath,
+		"--cmdline", "root=LABEL=hammer rw rootflags=subvol=@root quiet splash",
+		"--os-release", "@/etc/os-release",
+		"--output", out,
+	}
+	if cfg.pcrKey != "" {
+		args = append(args, "--pcr-private-key", cfg.pcrKey, "--pcr-banks", "sha256")
+	}
+	cmd := exec.Command("ukify", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func sbsign(path string, cfg secureBootConfig) error {
+	signed := path + ".signed"
+	cmd := exec.Command("sbsign", "--key", cfg.sbKey, "--cert", cfg.sbCert, "--output", signed, path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return os.Rename(signed, path)
+}
+
+// signStagedBootBinaries sbsigns every shim/GRUB/systemd-boot EFI binary
+// already placed under config/includes.binary, so Secure Boot firmware
+// will chain-load them.
+func signStagedBootBinaries(cfg secureBootConfig) error {
+	binDir := "config/includes.binary"
+	var signed int
+	err := filepath.Walk(binDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".efi":
+			if path == ukiPath {
+				return nil // already signed above
+			}
+			if err := sbsign(path, cfg); err != nil {
+				return fmt.Errorf("signing %s: %w", path, err)
+			}
+			signed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signed %d boot binaries and the UKI for Secure Boot.\n", signed)
+	return nil
+}
+
+// cmdSign re-signs an already-built UKI with a different Secure Boot key,
+// so the same build artifact can be shipped to environments with
+// different Secure Boot chains.
+func cmdSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	sbKey := fs.String("sb-key", "", "Secure Boot signing key")
+	sbCert := fs.String("sb-cert", "", "Secure Boot signing certificate")
+	pcrKey := fs.String("pcr-key", "", "TPM2 PCR private key used to re-sign the UKI's .pcrsig section")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: hammer-builder sign --sb-key <key> --sb-cert <cert> [--pcr-key <key>] <uki>")
+		os.Exit(1)
+	}
+	cfg := secureBootConfig{sbKey: *sbKey, sbCert: *sbCert, pcrKey: *pcrKey}
+	if !cfg.enabled() {
+		fmt.Println("Both --sb-key and --sb-cert are required.")
+		os.Exit(1)
+	}
+	target := fs.Arg(0)
+	if cfg.pcrKey != "" {
+		if err := resignPCR(target, cfg.pcrKey); err != nil {
+			fmt.Printf("Failed to re-sign PCR policy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := sbsign(target, cfg); err != nil {
+		fmt.Printf("Failed to sign %s: %v\n", target, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-signed %s\n", target)
+}
+
+func resignPCR(ukiPath, pcrKey string) error {
+	cmd := exec.Command("ukify", "sign", "--pcr-private-key", pcrKey, "--pcr-banks", "sha256", ukiPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrorClass buckets a Step failure so CI can branch on `echo $?` without
+// parsing log text. Each class maps to a fixed, distinct exit code.
+type ErrorClass string
+
+const (
+	ErrClassConfig ErrorClass = "config" // bad profile/flags, exit 10
+	ErrClassExec   ErrorClass = "exec"   // an external tool (lb, mmdebstrap, qemu...) failed, exit 11
+	ErrClassIO     ErrorClass = "io"     // filesystem read/write failed, exit 12
+	ErrClassSign   ErrorClass = "sign"   // Secure Boot / GPG signing failed, exit 13
+	ErrClassVerify ErrorClass = "verify" // a hash/test check failed, exit 14
+)
+
+var errorClassExitCodes = map[ErrorClass]int{
+	ErrClassConfig: 10,
+	ErrClassExec:   11,
+	ErrClassIO:     12,
+	ErrClassSign:   13,
+	ErrClassVerify: 14,
+}
+
+// StepError tags an error with the ErrorClass that should decide its
+// process exit code, without forcing every call site to know the mapping.
+type StepError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *StepError) Error() string { return fmt.Sprintf("[%s] %v", e.Class, e.Err) }
+func (e *StepError) Unwrap() error { return e.Err }
+
+func classify(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StepError{Class: class, Err: err}
+}
+
+func exitCodeFor(err error) int {
+	var stepErr *StepError
+	if asStepError(err, &stepErr) {
+		if code, ok := errorClassExitCodes[stepErr.Class]; ok {
+			return code
+		}
+	}
+	return 1
+}
+
+func asStepError(err error, target **StepError) bool {
+	for err != nil {
+		if se, ok := err.(*StepError); ok {
+			*target = se
+			return true
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// Step is one named unit of work in a build or init pipeline. Skip lets a
+// step opt out of the current run (the build's "sign" step does so when no
+// --sb-key is given); --resume instead skips steps that .hammer/state.json
+// records as completed. Rollback is best-effort cleanup run when Run fails.
+type Step struct {
+	Name     string
+	Run      func() error
+	Rollback func() error
+	Skip     func() bool
+}
+
+// stepLogEntry is the structured JSON line emitted to stderr for every
+// step, so CI can grep/parse build logs instead of scraping prose.
+type stepLogEntry struct {
+	Step       string `json:"step"`
+	ElapsedMS  int64  `json:"elapsed_ms"`
+	ExitCode   int    `json:"exit_code"`
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+}
+
+func logStep(entry stepLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// buildState is the resumable record of which steps of the most recent
+// pipeline run completed successfully.
+type buildState struct {
+	Completed map[string]bool `json:"completed"`
+}
+
+const stateDir = ".hammer"
+const stateFile = stateDir + "/state.json"
+
+func loadBuildState() *buildState {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return &buildState{Completed: map[string]bool{}}
+	}
+	var s buildState
+	if err := json.Unmarshal(data, &s); err != nil || s.Completed == nil {
+		return &buildState{Completed: map[string]bool{}}
+	}
+	return &s
+}
+
+func (s *buildState) save() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0644)
+}
+
+// runOptions controls which steps of a pipeline actually execute.
+type runOptions struct {
+	resume bool
+	from   string
+	until  string
+}
+
+// runSteps runs each step in order, emitting a structured log line per
+// step and persisting progress to .hammer/state.json as it goes so
+// --resume can pick back up after a failure without redoing earlier,
+// expensive steps (like debootstrap).
+func runSteps(steps []Step, opts runOptions) error {
+	state := loadBuildState()
+	started := opts.from == ""
+	for _, step := range steps {
+		if !started {
+			if step.Name == opts.from {
+				started = true
+			} else {
+				continue
+			}
+		}
+
+		if opts.resume && state.Completed[step.Name] {
+			logStep(stepLogEntry{Step: step.Name, Skipped: true})
+		} else if step.Skip != nil && step.Skip() {
+			logStep(stepLogEntry{Step: step.Name, Skipped: true})
+		} else {
+			start := time.Now()
+			err := step.Run()
+			entry := stepLogEntry{Step: step.Name, ElapsedMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				entry.ExitCode = exitCodeFor(err)
+				var stepErr *StepError
+				if asStepError(err, &stepErr) {
+					entry.ErrorClass = string(stepErr.Class)
+				}
+				entry.Error = err.Error()
+				logStep(entry)
+				if step.Rollback != nil {
+					step.Rollback()
+				}
+				return err
+			}
+			logStep(entry)
+		}
+
+		state.Completed[step.Name] = true
+		if err := state.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to persist build state: %v\n", err)
+		}
+		if step.Name == opts.until {
+			break
+		}
+	}
+	return nil
+}
+
+// failPipeline prints the single deterministic ERROR: line CI greps for
+// and exits with the code for err's class.
+func failPipeline(err error) {
+	fmt.Printf("ERROR: %v\n", err)
+	os.Exit(exitCodeFor(err))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackerOS-Linux-System/hammer/source-code/vmtest"
+)
+
+const testsDir = "tests"
+
+func cmdTest(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	isoPath := fs.String("iso", "", "ISO to boot; defaults to the first live-image-*.hybrid.iso in the current directory")
+	ovmfCode := fs.String("ovmf", "/usr/share/OVMF/OVMF_CODE.fd", "Path to OVMF_CODE.fd for UEFI boot")
+	bootTimeout := fs.Duration("boot-timeout", 3*time.Minute, "How long to wait for a usable shell after boot (login prompt, if any, plus login itself)")
+	loginUser := fs.String("login-user", "hacker", "Username to log in as (matches lb config's --bootappend-live live user)")
+	loginPassword := fs.String("login-password", "", "Password to send if the guest challenges for one; live images default to none")
+	junitOut := fs.String("junit", "hammer-vmtest.xml", "Path to write JUnit XML results to")
+	fs.Parse(args)
+
+	iso := *isoPath
+	if iso == "" {
+		iso = isoPathGuess()
+	}
+	if _, err := os.Stat(iso); err != nil {
+		fmt.Printf("ISO %s not found; run 'hammer-builder build' first.\n", iso)
+		os.Exit(1)
+	}
+
+	recipes, err := loadTestRecipes(testsDir)
+	if err != nil {
+		fmt.Printf("Failed to load tests/*.yaml: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Booting %s in QEMU...\n", iso)
+	vm, err := vmtest.Boot(vmtest.BootOptions{ISOPath: iso, OVMFCode: *ovmfCode})
+	if err != nil {
+		fmt.Printf("Failed to boot VM: %v\n", err)
+		os.Exit(1)
+	}
+	defer vm.Shutdown()
+
+	if err := vm.Login(*loginUser, *loginPassword, *bootTimeout); err != nil {
+		fmt.Printf("Failed logging in: %v\n", err)
+		os.Exit(1)
+	}
+
+	results := vmtest.RunChecklist(vm, recipes)
+	if err := vmtest.WriteJUnitXML(results, *junitOut); err != nil {
+		fmt.Printf("Warning: failed to write %s: %v\n", *junitOut, err)
+	}
+
+	failures := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+			failures++
+		}
+		fmt.Printf("[%s] %s (%s)\n", status, r.Name, r.Duration.Round(time.Millisecond))
+		if !r.Passed {
+			fmt.Println(r.Message)
+		}
+	}
+	if failures > 0 {
+		fmt.Printf("%d/%d checks failed\n", failures, len(results))
+		os.Exit(1)
+	}
+	fmt.Printf("All %d checks passed.\n", len(results))
+}
+
+func loadTestRecipes(dir string) ([]vmtest.Recipe, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var recipes []vmtest.Recipe
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var fileRecipes []vmtest.Recipe
+		if err := yaml.Unmarshal(data, &fileRecipes); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", e.Name(), err)
+		}
+		recipes = append(recipes, fileRecipes...)
+	}
+	return recipes, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	deploymentsRoot = "/btrfs-root/deployments"
+	currentLink     = "/btrfs-root/current"
+	pinnedFile      = "/btrfs-root/pinned"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	subcommand := os.Args[1]
+	args := os.Args[2:]
+	switch subcommand {
+	case "deploy":
+		cmdDeploy(args)
+	case "rollback":
+		cmdRollback(args)
+	case "list":
+		cmdList(args)
+	case "gc":
+		cmdGC(args)
+	case "pin":
+		cmdPin(args)
+	case "rebase":
+		cmdRebase(args)
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+// deployment describes a single Btrfs subvolume under deploymentsRoot.
+type deployment struct {
+	name    string // <channel>-<UTC-timestamp>-<shortsha>
+	channel string
+	created time.Time
+	sha     string
+}
+
+func cmdDeploy(args []string) {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	channel := fs.String("channel", "deb", "Deployment channel: deb, or oci")
+	image := fs.String("image", "", "OCI image reference to pull (requires --channel=oci)")
+	manifest := fs.String("manifest", "", "Path to the build's hammer-manifest.json to hash (deb channel); defaults to ./hammer-manifest.json")
+	dryRun := fs.Bool("dry-run", false, "Validate and print the plan without touching Btrfs")
+	fs.Parse(args)
+
+	if *channel == "oci" && *image == "" {
+		fmt.Println("Error: --image is required when --channel=oci")
+		os.Exit(1)
+	}
+
+	shortsha, err := manifestDigest(*channel, *manifest, *image)
+	if err != nil {
+		fmt.Printf("Failed to compute deployment digest: %v\n", err)
+		os.Exit(1)
+	}
+
+	name := fmt.Sprintf("%s-%s-%s", *channel, time.Now().UTC().Format("20060102T150405Z"), shortsha)
+	fmt.Printf("Preparing deployment %s\n", name)
+
+	if *dryRun {
+		fmt.Println("Dry run: would create working subvolume, populate it, snapshot read-only,")
+		fmt.Println("swap the current symlink, set the default subvolume, and regenerate the bootloader entry.")
+		return
+	}
+
+	workDir := filepath.Join(deploymentsRoot, ".work-"+name)
+	if err := createWorkingSubvolume(workDir); err != nil {
+		fmt.Printf("Failed to create working subvolume: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch *channel {
+	case "oci":
+		if err := populateFromImage(workDir, *image); err != nil {
+			fmt.Printf("Failed to populate from image %s: %v\n", *image, err)
+			os.Exit(1)
+		}
+	default:
+		if err := populateFromAPT(workDir); err != nil {
+			fmt.Printf("Failed to populate rootfs via apt/dpkg: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	finalPath := filepath.Join(deploymentsRoot, name)
+	if err := snapshotReadOnly(workDir, finalPath); err != nil {
+		fmt.Printf("Failed to create read-only snapshot: %v\n", err)
+		os.Exit(1)
+	}
+	if err := run("btrfs", "subvolume", "delete", workDir); err != nil {
+		fmt.Printf("Warning: failed to clean up working subvolume %s: %v\n", workDir, err)
+	}
+
+	if err := swapCurrent(finalPath); err != nil {
+		fmt.Printf("Failed to swap current deployment: %v\n", err)
+		os.Exit(1)
+	}
+	if err := regenerateBootEntry(name); err != nil {
+		fmt.Printf("Failed to regenerate bootloader entry: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Deployed %s and set it as the default boot target.\n", name)
+}
+
+// createWorkingSubvolume makes a writable subvolume from the current
+// deployment, mirroring the reflink parent/child workflow fsmgr uses for
+// its own images: snapshot the parent, then btrfstune -S0 so the clone no
+// longer shares a received-uuid and can be written to.
+func createWorkingSubvolume(workDir string) error {
+	parent, err := os.Readlink(currentLink)
+	if err != nil {
+		return run("btrfs", "subvolume", "create", workDir)
+	}
+	if err := run("btrfs", "subvolume", "snapshot", parent, workDir); err != nil {
+		return err
+	}
+	return run("btrfstune", "-f", "-S", "0", workDir)
+}
+
+// populateFromAPT refreshes and upgrades workDir's own package set. Both
+// calls use --root workDir so "update" fetches indices for workDir's actual
+// sources.list into workDir's own var/lib/apt/lists, instead of refreshing
+// the host's indices while "upgrade" reads workDir's stale ones.
+func populateFromAPT(workDir string) error {
+	if err := run("apt-get", "--root", workDir, "update"); err != nil {
+		return err
+	}
+	return run("apt-get", "--root", workDir, "upgrade", "-y")
+}
+
+func populateFromImage(workDir, image string) error {
+	if err := run("skopeo", "copy", "docker://"+image, "containers-storage:"+image); err != nil {
+		return err
+	}
+	mountPoint, err := exec.Command("podman", "image", "mount", image).Output()
+	if err != nil {
+		return fmt.Errorf("podman image mount: %w", err)
+	}
+	src := strings.TrimSpace(string(mountPoint))
+	defer exec.Command("podman", "image", "unmount", image).Run()
+	return run("rsync", "-a", "--delete", src+"/", workDir+"/")
+}
+
+func snapshotReadOnly(workDir, finalPath string) error {
+	return run("btrfs", "subvolume", "snapshot", "-r", workDir, finalPath)
+}
+
+func swapCurrent(finalPath string) error {
+	tmpLink := currentLink + ".new"
+	os.Remove(tmpLink)
+	if err := os.Symlink(finalPath, tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, currentLink)
+}
+
+func regenerateBootEntry(name string) error {
+	id, err := subvolumeID(filepath.Join(deploymentsRoot, name))
+	if err != nil {
+		return err
+	}
+	if err := run("btrfs", "subvolume", "set-default", id, deploymentsRoot); err != nil {
+		return err
+	}
+	if _, err := os.Stat("/boot/loader"); err == nil {
+		return writeSystemdBootEntry(name)
+	}
+	return writeGrubEntry(name)
+}
+
+func writeSystemdBootEntry(name string) error {
+	entry := fmt.Sprintf(`title   Hammer (%s)
+linux   /vmlinuz
+initrd  /initrd.img
+options root=LABEL=hammer rw rootflags=subvol=@deployments/%s
+`, name, name)
+	path := filepath.Join("/boot/loader/entries", "hammer-"+name+".conf")
+	return os.WriteFile(path, []byte(entry), 0644)
+}
+
+func writeGrubEntry(name string) error {
+	entry := fmt.Sprintf(`menuentry "Hammer (%s)" {
+	search --no-floppy --fs-uuid --set=root $rootuuid
+	linux /vmlinuz root=LABEL=hammer rw rootflags=subvol=@deployments/%s
+	initrd /initrd.img
+}
+`, name, name)
+	path := filepath.Join("/boot/grub/hammer-" + name + ".cfg")
+	return os.WriteFile(path, []byte(entry), 0644)
+}
+
+func subvolumeID(path string) (string, error) {
+	out, err := exec.Command("btrfs", "subvolume", "show", path).Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Subvolume ID:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Subvolume ID:")), nil
+		}
+	}
+	return "", fmt.Errorf("subvolume ID not found for %s", path)
+}
+
+func manifestDigest(channel, manifestPath, image string) (string, error) {
+	if channel == "oci" {
+		if image == "" {
+			return "", fmt.Errorf("no image reference given")
+		}
+		digest, err := ociImageDigest(image)
+		if err != nil {
+			return "", fmt.Errorf("resolving digest for %s: %w", image, err)
+		}
+		return shortsha(digest), nil
+	}
+	if manifestPath == "" {
+		manifestPath = "hammer-manifest.json"
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12], nil
+}
+
+// ociImageDigest resolves image to its content digest via skopeo inspect,
+// rather than hashing the tag text, so re-deploying the same tag after its
+// upstream content changes produces a distinct deployment name instead of
+// silently reusing the previous one.
+func ociImageDigest(image string) (string, error) {
+	out, err := exec.Command("skopeo", "inspect", "--format", "{{.Digest}}", "docker://"+image).Output()
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(out))
+	if digest == "" {
+		return "", fmt.Errorf("empty digest returned by skopeo inspect")
+	}
+	return digest, nil
+}
+
+func shortsha(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+func cmdRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	fs.Parse(args)
+
+	deployments, err := listDeployments()
+	if err != nil {
+		fmt.Printf("Failed to list deployments: %v\n", err)
+		os.Exit(1)
+	}
+	current, err := os.Readlink(currentLink)
+	if err != nil {
+		fmt.Printf("Failed to read current deployment: %v\n", err)
+		os.Exit(1)
+	}
+	currentName := filepath.Base(current)
+	idx := -1
+	for i, d := range deployments {
+		if d.name == currentName {
+			idx = i
+			break
+		}
+	}
+	if idx <= 0 {
+		fmt.Println("No previous deployment available to roll back to.")
+		os.Exit(1)
+	}
+	previous := deployments[idx-1]
+	if err := swapCurrent(filepath.Join(deploymentsRoot, previous.name)); err != nil {
+		fmt.Printf("Failed to swap current deployment: %v\n", err)
+		os.Exit(1)
+	}
+	if err := regenerateBootEntry(previous.name); err != nil {
+		fmt.Printf("Failed to regenerate bootloader entry: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rolled back to %s\n", previous.name)
+}
+
+func cmdList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Parse(args)
+
+	deployments, err := listDeployments()
+	if err != nil {
+		fmt.Printf("Failed to list deployments: %v\n", err)
+		os.Exit(1)
+	}
+	current, _ := os.Readlink(currentLink)
+	pinned := readPinned()
+	for _, d := range deployments {
+		marker := " "
+		if filepath.Join(deploymentsRoot, d.name) == current {
+			marker = "*"
+		}
+		pin := ""
+		if pinned[d.name] {
+			pin = " (pinned)"
+		}
+		fmt.Printf("%s %s%s\n", marker, d.name, pin)
+	}
+}
+
+func cmdGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	keepRecent := fs.Int("keep-recent", 3, "Number of most-recent deployments to keep")
+	fs.Parse(args)
+
+	deployments, err := listDeployments()
+	if err != nil {
+		fmt.Printf("Failed to list deployments: %v\n", err)
+		os.Exit(1)
+	}
+	pinned := readPinned()
+	current, _ := os.Readlink(currentLink)
+
+	keep := map[string]bool{}
+	for i := len(deployments) - 1; i >= 0 && len(deployments)-1-i < *keepRecent; i-- {
+		keep[deployments[i].name] = true
+	}
+	for name := range pinned {
+		keep[name] = true
+	}
+
+	for _, d := range deployments {
+		path := filepath.Join(deploymentsRoot, d.name)
+		if keep[d.name] || path == current {
+			continue
+		}
+		fmt.Printf("Removing deployment %s\n", d.name)
+		if err := run("btrfs", "subvolume", "delete", path); err != nil {
+			fmt.Printf("Failed to delete %s: %v\n", d.name, err)
+		}
+	}
+}
+
+func cmdPin(args []string) {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	unpin := fs.Bool("unpin", false, "Remove the pin instead of adding it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: hammer-updater pin [--unpin] <deployment>")
+		os.Exit(1)
+	}
+	name := fs.Arg(0)
+	pinned := readPinned()
+	if *unpin {
+		delete(pinned, name)
+	} else {
+		pinned[name] = true
+	}
+	if err := writePinned(pinned); err != nil {
+		fmt.Printf("Failed to update pinned list: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func cmdRebase(args []string) {
+	fs := flag.NewFlagSet("rebase", flag.ExitOnError)
+	channel := fs.String("channel", "oci", "Channel to rebase onto: deb, or oci")
+	image := fs.String("image", "", "OCI image reference (required for --channel=oci)")
+	fs.Parse(args)
+
+	if *channel == "oci" && *image == "" {
+		fmt.Println("Error: --image is required when --channel=oci")
+		os.Exit(1)
+	}
+	fmt.Printf("Rebasing onto channel %q\n", *channel)
+	fmt.Println("Preserving /home and /var subvolumes across the channel switch.")
+
+	deployArgs := []string{"--channel", *channel}
+	if *image != "" {
+		deployArgs = append(deployArgs, "--image", *image)
+	}
+	cmdDeploy(deployArgs)
+}
+
+func listDeployments() ([]deployment, error) {
+	entries, err := os.ReadDir(deploymentsRoot)
+	if err != nil {
+		return nil, err
+	}
+	var deployments []deployment
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		parts := strings.SplitN(e.Name(), "-", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		created, err := time.Parse("20060102T150405Z", parts[1])
+		if err != nil {
+			continue
+		}
+		deployments = append(deployments, deployment{
+			name:    e.Name(),
+			channel: parts[0],
+			created: created,
+			sha:     parts[2],
+		})
+	}
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].created.Before(deployments[j].created)
+	})
+	return deployments, nil
+}
+
+func readPinned() map[string]bool {
+	pinned := map[string]bool{}
+	data, err := os.ReadFile(pinnedFile)
+	if err != nil {
+		return pinned
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			pinned[line] = true
+		}
+	}
+	return pinned
+}
+
+func writePinned(pinned map[string]bool) error {
+	names := make([]string, 0, len(pinned))
+	for name := range pinned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return os.WriteFile(pinnedFile, []byte(strings.Join(names, "\n")+"\n"), 0644)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func usage() {
+	fmt.Println("Usage: hammer-updater <command> [options]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	fmt.Println(" deploy   [--channel <deb|oci>] [--image <ref>] [--dry-run]  Create and switch to a new deployment")
+	fmt.Println(" rollback                                                    Switch back to the previous deployment")
+	fmt.Println(" list                                                        List deployments, current marked with *")
+	fmt.Println(" gc       [--keep-recent <n>]                                Delete unpinned deployments beyond the keep window")
+	fmt.Println(" pin      [--unpin] <deployment>                             Pin or unpin a deployment so gc skips it")
+	fmt.Println(" rebase   [--channel <deb|oci>] [--image <ref>]              Switch deployment channel, preserving /home and /var")
+}
@@ -0,0 +1,338 @@
+// Package vmtest boots a built ISO in QEMU/KVM and drives a scripted
+// checklist over its serial console, so hammer-builder can catch installer
+// and atomic-setup regressions that a build-only flow would silently ship.
+package vmtest
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// BootOptions configures the QEMU guest a test run boots.
+type BootOptions struct {
+	ISOPath  string
+	OVMFCode string // path to OVMF_CODE.fd; empty disables UEFI/Secure Boot
+	Memory   string // e.g. "2048"
+}
+
+// VM is a running QEMU guest with its serial console wired up for sending
+// commands and scanning for prompts. A background goroutine pumps the
+// console's raw bytes into out, so WaitForPrompt/Login/RunCommand can all
+// see prompts (login:, Password:, a shell's PS1) the instant they appear
+// instead of waiting for a trailing newline that may never come.
+type VM struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   chan byte
+	buf   strings.Builder
+}
+
+// Boot starts the guest and returns once the QEMU process is running;
+// callers should follow up with Login to know when it's usable.
+func Boot(opts BootOptions) (*VM, error) {
+	args := []string{
+		"-m", defaultString(opts.Memory, "2048"),
+		"-cdrom", opts.ISOPath,
+		"-serial", "stdio",
+		"-display", "none",
+		"-no-reboot",
+	}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		args = append(args, "-enable-kvm")
+	}
+	if opts.OVMFCode != "" {
+		args = append(args, "-bios", opts.OVMFCode)
+	}
+	cmd := exec.Command("qemu-system-x86_64", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting qemu: %w", err)
+	}
+	vm := &VM{cmd: cmd, stdin: stdin, out: make(chan byte, 4096)}
+	go vm.pump(stdout)
+	return vm, nil
+}
+
+// pump is the sole reader of the guest's serial console; every other
+// method reads from vm.out instead, so there's never more than one
+// concurrent reader on the underlying pipe.
+func (vm *VM) pump(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for i := 0; i < n; i++ {
+			vm.out <- buf[i]
+		}
+		if err != nil {
+			close(vm.out)
+			return
+		}
+	}
+}
+
+var errReadTimeout = errors.New("timed out waiting for output")
+
+// readUntil appends bytes from the console to vm.buf, calling onByte (if
+// set) and then isMatch after each one, until isMatch reports a match or
+// timeout elapses. Matching byte-by-byte against the buffer's tail (not
+// line-by-line) is what lets callers catch prompts that never end in a
+// newline, such as "login:" or "Password:".
+func (vm *VM) readUntil(timeout time.Duration, isMatch func(tail string) bool, onByte func(tail string) error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errReadTimeout
+		}
+		select {
+		case b, ok := <-vm.out:
+			if !ok {
+				return io.EOF
+			}
+			vm.buf.WriteByte(b)
+			tail := tailOf(vm.buf.String(), 512)
+			if onByte != nil {
+				if err := onByte(tail); err != nil {
+					return err
+				}
+			}
+			if isMatch(tail) {
+				return nil
+			}
+		case <-time.After(remaining):
+			return errReadTimeout
+		}
+	}
+}
+
+// tailOf returns the last n characters of s, so prompt matching only
+// looks at recently-arrived output instead of rescanning the whole
+// transcript on every byte.
+func tailOf(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
+
+// WaitForPrompt reads serial output until pattern appears or timeout
+// elapses.
+func (vm *VM) WaitForPrompt(pattern string, timeout time.Duration) error {
+	switch err := vm.readUntil(timeout, func(tail string) bool { return strings.Contains(tail, pattern) }, nil); err {
+	case nil:
+		return nil
+	case io.EOF:
+		return fmt.Errorf("guest serial console closed waiting for %q", pattern)
+	default:
+		return fmt.Errorf("timed out waiting for %q", pattern)
+	}
+}
+
+// shellPrompt reports whether tail ends in what looks like username's
+// shell prompt (e.g. "hacker@hammer:~$ "), rather than just any "$ "/"# "
+// substring, which turns up incidentally in ordinary boot-log lines.
+func shellPrompt(username, tail string) bool {
+	if !strings.HasSuffix(tail, "$ ") && !strings.HasSuffix(tail, "# ") {
+		return false
+	}
+	return strings.Contains(tail, username+"@")
+}
+
+// Login waits for the guest to reach a usable shell, answering a
+// "login:"/"Password:" challenge along the way if one appears. hammer's
+// own live images auto-login the boot user (see lb config's
+// --bootappend-live in backend.go) and never print a login prompt at
+// all, so Login tolerates both that case and a real login prompt, rather
+// than assuming one always happens.
+func (vm *VM) Login(username, password string, timeout time.Duration) error {
+	sentUser, sentPassword := false, false
+	onByte := func(tail string) error {
+		switch {
+		case !sentUser && strings.Contains(tail, "login:"):
+			if _, err := io.WriteString(vm.stdin, username+"\n"); err != nil {
+				return err
+			}
+			sentUser = true
+		case !sentPassword && strings.Contains(tail, "Password:"):
+			if _, err := io.WriteString(vm.stdin, password+"\n"); err != nil {
+				return err
+			}
+			sentPassword = true
+		}
+		return nil
+	}
+	isMatch := func(tail string) bool { return shellPrompt(username, tail) }
+	switch err := vm.readUntil(timeout, isMatch, onByte); err {
+	case nil:
+		return nil
+	case io.EOF:
+		return fmt.Errorf("guest serial console closed waiting for a shell prompt")
+	default:
+		return fmt.Errorf("timed out waiting for a shell prompt after login")
+	}
+}
+
+// RunCommand sends a command over the serial console and waits for the
+// sentinel this package appends to every command, returning the output in
+// between and the shell's exit code.
+func (vm *VM) RunCommand(command string) (output string, exitCode int, err error) {
+	const sentinel = "__HAMMER_VMTEST_DONE__"
+	start := vm.buf.Len()
+	// The sentinel is typed split by an empty "" so the console's echo of
+	// the command line never contains it; only echo's own output does.
+	typed := sentinel[:16] + `""` + sentinel[16:]
+	if _, err = io.WriteString(vm.stdin, fmt.Sprintf("%s; echo %s $?\n", command, typed)); err != nil {
+		return "", -1, err
+	}
+	isMatch := func(tail string) bool {
+		idx := strings.Index(tail, sentinel)
+		return idx != -1 && strings.Contains(tail[idx:], "\n")
+	}
+	readErr := vm.readUntil(2*time.Minute, isMatch, nil)
+	full := vm.buf.String()[start:]
+	idx := strings.Index(full, sentinel)
+	if idx == -1 {
+		if readErr == nil {
+			readErr = errReadTimeout
+		}
+		return full, -1, fmt.Errorf("timed out waiting for command to complete: %s: %w", command, readErr)
+	}
+	fmt.Sscanf(strings.TrimSpace(full[idx+len(sentinel):]), "%d", &exitCode)
+	return full[:idx], exitCode, nil
+}
+
+// Shutdown sends a power-off command and kills the QEMU process if it
+// hasn't exited shortly after.
+func (vm *VM) Shutdown() error {
+	io.WriteString(vm.stdin, "poweroff\n")
+	done := make(chan error, 1)
+	go func() { done <- vm.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(15 * time.Second):
+		vm.cmd.Process.Kill()
+		return fmt.Errorf("guest did not power off in time, killed")
+	}
+}
+
+// Result is the outcome of one checklist item or declared test recipe.
+type Result struct {
+	Name     string
+	Passed   bool
+	Duration time.Duration
+	Message  string
+}
+
+// Recipe is a user-declared test loaded from tests/*.yaml: a command to
+// run over the serial console, its expected exit code, and files that
+// must exist afterward.
+type Recipe struct {
+	Name             string   `yaml:"name"`
+	Command          string   `yaml:"command"`
+	ExpectedExitCode int      `yaml:"expected_exit_code"`
+	MustExist        []string `yaml:"must_exist"`
+}
+
+// builtinChecklist exercises the invariants every hammer ISO must satisfy:
+// Secure Boot state, the fixed BTRFS subvolume layout, a dry-run deploy,
+// and that Calamares actually launches.
+func builtinChecklist() []Recipe {
+	return []Recipe{
+		{Name: "secure-boot-state", Command: "mokutil --sb-state", ExpectedExitCode: 0},
+		{Name: "btrfs-subvolumes", Command: "sh -c 'for s in @root @home @var @snapshots; do btrfs subvolume list / | grep -q \"$s\" || exit 1; done'", ExpectedExitCode: 0},
+		{Name: "updater-dry-run-deploy", Command: "hammer-updater deploy --dry-run", ExpectedExitCode: 0},
+		{Name: "calamares-launches", Command: "pgrep -x calamares", ExpectedExitCode: 0},
+	}
+}
+
+// RunChecklist runs the built-in checklist followed by any recipes loaded
+// from tests/*.yaml.
+func RunChecklist(vm *VM, extra []Recipe) []Result {
+	recipes := append(builtinChecklist(), extra...)
+	results := make([]Result, 0, len(recipes))
+	for _, r := range recipes {
+		start := time.Now()
+		output, exitCode, err := vm.RunCommand(r.Command)
+		res := Result{Name: r.Name, Duration: time.Since(start)}
+		switch {
+		case err != nil:
+			res.Message = err.Error()
+		case exitCode != r.ExpectedExitCode:
+			res.Message = fmt.Sprintf("exit code %d, want %d\n%s", exitCode, r.ExpectedExitCode, output)
+		default:
+			res.Passed = true
+		}
+		if res.Passed {
+			for _, path := range r.MustExist {
+				if existsOutput, code, _ := vm.RunCommand("test -e " + path); code != 0 {
+					res.Passed = false
+					res.Message = fmt.Sprintf("expected %s to exist\n%s", path, existsOutput)
+					break
+				}
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnitXML writes results in JUnit XML so CI can surface them
+// alongside every other test suite.
+func WriteJUnitXML(results []Result, path string) error {
+	suite := junitTestsuite{Name: "hammer-builder-vmtest", Tests: len(results)}
+	for _, r := range results {
+		tc := junitTestcase{Name: r.Name, ClassName: "vmtest", Time: r.Duration.Seconds()}
+		if !r.Passed {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: "checklist item failed", Text: r.Message}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), data...), 0644)
+}
+
+func defaultString(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}